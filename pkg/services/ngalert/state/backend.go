@@ -0,0 +1,169 @@
+package state
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	"github.com/grafana/grafana/pkg/services/ngalert/metrics"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// Backend selects which StateStore implementation NewStateStore builds.
+type Backend string
+
+const (
+	// BackendMemory keeps all state in the local process, as today.
+	BackendMemory Backend = "memory"
+	// BackendRedis shares state through a Redis instance so it survives a
+	// single replica restarting and stays consistent across replicas.
+	BackendRedis Backend = "redis"
+	// BackendRedisMigration reads from memory and writes through to Redis,
+	// for the transition window while rolling out BackendRedis.
+	BackendRedisMigration Backend = "redis-migration"
+)
+
+// BackendConfig configures StateStore backend selection.
+type BackendConfig struct {
+	Backend     Backend
+	RedisClient *redis.Client
+	// MaxAlertsPerRule bounds how many cache entries a single rule may hold
+	// in the memory backend, evicting the least-recently-updated entries
+	// once exceeded; 0 disables eviction. See cache.maxAlertsPerRule.
+	MaxAlertsPerRule int
+}
+
+// NewStateStore builds the StateStore selected by cfg.Backend. Selecting
+// BackendRedis with a configured client trades away batched restore,
+// stale-series resolution, cancellation and LRU eviction (see
+// AdvancedStateStore); NewStateStore logs a warning in that case so the
+// limitation isn't silent. BackendRedisMigration keeps them, since its
+// writeThroughStore delegates them to the memory cache.
+func NewStateStore(cfg BackendConfig, logger log.Logger, metrics *metrics.State, externalURL *url.URL) StateStore {
+	mem := newCache(logger, metrics, externalURL).withMaxAlertsPerRule(cfg.MaxAlertsPerRule)
+
+	var store StateStore
+	switch cfg.Backend {
+	case BackendRedis:
+		if cfg.RedisClient == nil {
+			logger.Warn("redis alert state backend selected but no redis client was configured, falling back to memory", "backend", cfg.Backend)
+			store = mem
+			break
+		}
+		store = newStateStoreRedis(cfg.RedisClient, logger, metrics, externalURL)
+	case BackendRedisMigration:
+		if cfg.RedisClient == nil {
+			logger.Warn("redis-migration alert state backend selected but no redis client was configured, falling back to memory", "backend", cfg.Backend)
+			store = mem
+			break
+		}
+		redisStore := newStateStoreRedis(cfg.RedisClient, logger, metrics, externalURL)
+		store = &writeThroughStore{primary: mem, secondary: redisStore, log: logger}
+	case BackendMemory, "":
+		store = mem
+	default:
+		logger.Warn("unknown alert state backend, falling back to memory", "backend", cfg.Backend)
+		store = mem
+	}
+
+	if _, ok := store.(AdvancedStateStore); !ok {
+		logger.Warn("selected alert state backend does not support batched restore, stale-series resolution, cancellation or per-rule eviction; these remain memory-backend-only features", "backend", cfg.Backend)
+	}
+	return store
+}
+
+// writeThroughStore reads from primary (memory) and duplicates every write
+// to secondary (Redis), so state can be migrated to the shared backend
+// without a cutover that loses in-flight state.
+type writeThroughStore struct {
+	primary   StateStore
+	secondary StateStore
+	log       log.Logger
+}
+
+func (w *writeThroughStore) GetOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
+	state := w.primary.GetOrCreate(ctx, alertRule, result)
+	w.secondary.Set(state)
+	return state
+}
+
+func (w *writeThroughStore) Get(orgID int64, alertRuleUID, stateID string) (*State, error) {
+	return w.primary.Get(orgID, alertRuleUID, stateID)
+}
+
+func (w *writeThroughStore) GetAll(orgID int64) []*State {
+	return w.primary.GetAll(orgID)
+}
+
+func (w *writeThroughStore) GetStatesForRuleUID(orgID int64, alertRuleUID string) []*State {
+	return w.primary.GetStatesForRuleUID(orgID, alertRuleUID)
+}
+
+func (w *writeThroughStore) Set(entry *State) {
+	w.primary.Set(entry)
+	w.secondary.Set(entry)
+}
+
+func (w *writeThroughStore) DeleteEntry(orgID int64, alertRuleUID, cacheID string) {
+	w.primary.DeleteEntry(orgID, alertRuleUID, cacheID)
+	w.secondary.DeleteEntry(orgID, alertRuleUID, cacheID)
+}
+
+func (w *writeThroughStore) RemoveByRuleUID(orgID int64, uid string) {
+	w.primary.RemoveByRuleUID(orgID, uid)
+	w.secondary.RemoveByRuleUID(orgID, uid)
+}
+
+func (w *writeThroughStore) Reset() {
+	w.primary.Reset()
+	w.secondary.Reset()
+}
+
+func (w *writeThroughStore) RecordMetrics() {
+	w.primary.RecordMetrics()
+}
+
+// writeThroughStore's primary is always the in-memory cache, which
+// implements AdvancedStateStore, so the migration backend keeps batched
+// restore, stale-series resolution, cancellation and eviction fully working
+// by delegating straight to it; only the secondary (Redis) write-through
+// lacks these.
+var _ AdvancedStateStore = (*writeThroughStore)(nil)
+
+func (w *writeThroughStore) RestoreStartsAt(ctx context.Context, orgID int64, ruleUIDs []string, reader InstanceHistoryReader) {
+	if adv, ok := w.primary.(AdvancedStateStore); ok {
+		adv.RestoreStartsAt(ctx, orgID, ruleUIDs, reader)
+	}
+}
+
+func (w *writeThroughStore) MarkStale(orgID int64, ruleUID string, currentIDs map[string]data.Labels, evaluatedAt time.Time) []*State {
+	if adv, ok := w.primary.(AdvancedStateStore); ok {
+		return adv.MarkStale(orgID, ruleUID, currentIDs, evaluatedAt)
+	}
+	return nil
+}
+
+func (w *writeThroughStore) CancelOrg(orgID int64) {
+	if adv, ok := w.primary.(AdvancedStateStore); ok {
+		adv.CancelOrg(orgID)
+	}
+}
+
+func (w *writeThroughStore) CancelRule(orgID int64, uid string) {
+	if adv, ok := w.primary.(AdvancedStateStore); ok {
+		adv.CancelRule(orgID, uid)
+	}
+}
+
+func (w *writeThroughStore) SweepStaleNormal(orgID int64, ruleUID string, now time.Time, maxAge time.Duration) int {
+	if adv, ok := w.primary.(AdvancedStateStore); ok {
+		return adv.SweepStaleNormal(orgID, ruleUID, now, maxAge)
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+func TestNewStateStore_RedisBackendWithoutClientFallsBackToMemory(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	store := NewStateStore(BackendConfig{Backend: BackendRedis, RedisClient: nil}, logger, nil, nil)
+	_, isMemory := store.(*cache)
+	require.True(t, isMemory, "a nil redis client must fail closed to the memory backend, not panic on first use")
+
+	store = NewStateStore(BackendConfig{Backend: BackendRedisMigration, RedisClient: nil}, logger, nil, nil)
+	_, isMemory = store.(*cache)
+	require.True(t, isMemory, "a nil redis client must fail closed to the memory backend, not panic on first use")
+}
+
+func TestNewStateStore_UnknownBackendFallsBackToMemory(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	store := NewStateStore(BackendConfig{Backend: Backend("bogus")}, logger, nil, nil)
+	_, isMemory := store.(*cache)
+	require.True(t, isMemory)
+}
+
+func TestNewStateStore_WiresMaxAlertsPerRuleIntoMemoryCache(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	store := NewStateStore(BackendConfig{Backend: BackendMemory, MaxAlertsPerRule: 3}, logger, nil, nil)
+	c, ok := store.(*cache)
+	require.True(t, ok)
+	require.Equal(t, 3, c.maxAlertsPerRule, "MaxAlertsPerRule must reach the memory cache constructed by NewStateStore")
+}
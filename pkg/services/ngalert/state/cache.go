@@ -22,35 +22,52 @@ type cache struct {
 	log         log.Logger
 	metrics     *metrics.State
 	externalURL *url.URL
+
+	// seriesInPreviousEval tracks the label-sets seen on a rule's previous
+	// evaluation, keyed by ruleEvalKey(orgID, ruleUID) > cacheID > labels.
+	// Used by markStale to detect label-sets that disappeared between
+	// evaluations.
+	seriesInPreviousEval map[string]map[string]data.Labels
+
+	// ctxTree is the root of the per-org/per-rule cancellation tree that
+	// getOrCreate derives its working context from, so CancelOrg/CancelRule
+	// can abort in-flight template expansion and backend calls.
+	ctxTree *scopedContext
+
+	// maxAlertsPerRule bounds how many cache entries a single rule may hold;
+	// 0 disables eviction. ruleIndexes tracks the LRU-of-cacheIDs used to
+	// enforce it, keyed by ruleEvalKey(orgID, ruleUID).
+	maxAlertsPerRule int
+	ruleIndexes      map[string]*ruleIndex
 }
 
 func newCache(logger log.Logger, metrics *metrics.State, externalURL *url.URL) *cache {
 	return &cache{
-		states:      make(map[int64]map[string]map[string]*State),
-		log:         logger,
-		metrics:     metrics,
-		externalURL: externalURL,
+		states:               make(map[int64]map[string]map[string]*State),
+		log:                  logger,
+		metrics:              metrics,
+		externalURL:          externalURL,
+		seriesInPreviousEval: make(map[string]map[string]data.Labels),
+		ctxTree:              newScopedContext(),
+		ruleIndexes:          make(map[string]*ruleIndex),
 	}
 }
 
-func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
-	c.mtxStates.Lock()
-	defer c.mtxStates.Unlock()
+// withMaxAlertsPerRule sets the per-rule cache entry cap used by the
+// eviction path; 0 (the default from newCache) disables eviction entirely.
+func (c *cache) withMaxAlertsPerRule(max int) *cache {
+	c.maxAlertsPerRule = max
+	return c
+}
 
-	// clone the labels so we don't change eval.Result
-	labels := result.Instance.Copy()
-	attachRuleLabels(labels, alertRule)
-	ruleLabels, annotations := c.expandRuleLabelsAndAnnotations(ctx, alertRule, labels, result)
+func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
+	ruleCtx, done := c.ctxTree.forRule(ctx, alertRule.OrgID, alertRule.UID)
+	defer done()
 
-	// if duplicate labels exist, alertRule label will take precedence
-	lbs := mergeLabels(ruleLabels, result.Instance)
-	attachRuleLabels(lbs, alertRule)
+	lbs, annotations, id := prepareInstance(ruleCtx, alertRule, result, c.log, c.externalURL)
 
-	il := ngModels.InstanceLabels(lbs)
-	id, err := il.StringKey()
-	if err != nil {
-		c.log.Error("error getting cacheId for entry", "err", err.Error())
-	}
+	c.mtxStates.Lock()
+	defer c.mtxStates.Unlock()
 
 	if _, ok := c.states[alertRule.OrgID]; !ok {
 		c.states[alertRule.OrgID] = make(map[string]map[string]*State)
@@ -60,19 +77,10 @@ func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule,
 	}
 
 	if state, ok := c.states[alertRule.OrgID][alertRule.UID][id]; ok {
-		// Annotations can change over time, however we also want to maintain
-		// certain annotations across evaluations
-		for k, v := range state.Annotations {
-			if _, ok := ngModels.InternalAnnotationNameSet[k]; ok {
-				// If the annotation is not present then it should be copied from the
-				// previous state to the next state
-				if _, ok := annotations[k]; !ok {
-					annotations[k] = v
-				}
-			}
-		}
-		state.Annotations = annotations
+		state.Annotations = mergeForwardInternalAnnotations(state.Annotations, annotations)
+		state.EvaluationDuration = result.EvaluationDuration
 		c.states[alertRule.OrgID][alertRule.UID][id] = state
+		c.touchRuleIndexLocked(alertRule.OrgID, alertRule.UID, id)
 		return state
 	}
 
@@ -90,6 +98,7 @@ func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule,
 		newState.StartsAt = result.EvaluatedAt
 	}
 	c.states[alertRule.OrgID][alertRule.UID][id] = newState
+	c.touchRuleIndexLocked(alertRule.OrgID, alertRule.UID, id)
 	return newState
 }
 
@@ -99,14 +108,55 @@ func attachRuleLabels(m map[string]string, alertRule *ngModels.AlertRule) {
 	m[prometheusModel.AlertNameLabel] = alertRule.Title
 }
 
-func (c *cache) expandRuleLabelsAndAnnotations(ctx context.Context, alertRule *ngModels.AlertRule, labels map[string]string, alertInstance eval.Result) (map[string]string, map[string]string) {
+// prepareInstance computes the label set, expanded annotations and cache ID
+// for an evaluation result the same way regardless of which StateStore
+// backend ends up persisting it: expand the rule's labels/annotations
+// templates, merge the expanded labels with the instance's own labels
+// (rule labels take precedence on conflict), then attach the rule-identity
+// labels and derive the cache ID from the result. Every StateStore
+// implementation must go through this so the same rule/instance produces
+// the same label set and cache ID no matter which backend is selected.
+func prepareInstance(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result, logger log.Logger, externalURL *url.URL) (data.Labels, map[string]string, string) {
+	// clone the labels so we don't change eval.Result
+	labels := result.Instance.Copy()
+	attachRuleLabels(labels, alertRule)
+	ruleLabels, annotations := expandRuleLabelsAndAnnotations(ctx, alertRule, labels, result, logger, externalURL)
+
+	// if duplicate labels exist, alertRule label will take precedence
+	lbs := mergeLabels(ruleLabels, result.Instance)
+	attachRuleLabels(lbs, alertRule)
+
+	id, err := ngModels.InstanceLabels(lbs).StringKey()
+	if err != nil {
+		logger.Error("error getting cacheId for entry", "err", err.Error())
+	}
+	return lbs, annotations, id
+}
+
+// mergeForwardInternalAnnotations carries forward any internal annotation
+// present on an existing state's annotations but missing from the freshly
+// expanded set, since annotations can change over time but certain internal
+// ones (e.g. those recording state-transition bookkeeping) must survive
+// across evaluations.
+func mergeForwardInternalAnnotations(existing, next map[string]string) map[string]string {
+	for k, v := range existing {
+		if _, ok := ngModels.InternalAnnotationNameSet[k]; ok {
+			if _, ok := next[k]; !ok {
+				next[k] = v
+			}
+		}
+	}
+	return next
+}
+
+func expandRuleLabelsAndAnnotations(ctx context.Context, alertRule *ngModels.AlertRule, labels map[string]string, alertInstance eval.Result, logger log.Logger, externalURL *url.URL) (map[string]string, map[string]string) {
 	expand := func(original map[string]string) map[string]string {
 		expanded := make(map[string]string, len(original))
 		for k, v := range original {
-			ev, err := expandTemplate(ctx, alertRule.Title, v, labels, alertInstance, c.externalURL)
+			ev, err := expandTemplate(ctx, alertRule.Title, v, labels, alertInstance, externalURL)
 			expanded[k] = ev
 			if err != nil {
-				c.log.Error("error in expanding template", "name", k, "value", v, "err", err.Error())
+				logger.Error("error in expanding template", "name", k, "value", v, "err", err.Error())
 				// Store the original template on error.
 				expanded[k] = v
 			}
@@ -127,6 +177,7 @@ func (c *cache) set(entry *State) {
 		c.states[entry.OrgID][entry.AlertRuleUID] = make(map[string]*State)
 	}
 	c.states[entry.OrgID][entry.AlertRuleUID][entry.CacheId] = entry
+	c.touchRuleIndexLocked(entry.OrgID, entry.AlertRuleUID, entry.CacheId)
 }
 
 func (c *cache) get(orgID int64, alertRuleUID, stateId string) (*State, error) {
@@ -165,12 +216,14 @@ func (c *cache) removeByRuleUID(orgID int64, uid string) {
 	c.mtxStates.Lock()
 	defer c.mtxStates.Unlock()
 	delete(c.states[orgID], uid)
+	delete(c.ruleIndexes, ruleEvalKey(orgID, uid))
 }
 
 func (c *cache) reset() {
 	c.mtxStates.Lock()
 	defer c.mtxStates.Unlock()
 	c.states = make(map[int64]map[string]map[string]*State)
+	c.ruleIndexes = make(map[string]*ruleIndex)
 }
 
 func (c *cache) recordMetrics() {
@@ -220,4 +273,7 @@ func (c *cache) deleteEntry(orgID int64, alertRuleUID, cacheID string) {
 	c.mtxStates.Lock()
 	defer c.mtxStates.Unlock()
 	delete(c.states[orgID][alertRuleUID], cacheID)
+	if idx, ok := c.ruleIndexes[ruleEvalKey(orgID, alertRuleUID)]; ok {
+		idx.remove(cacheID)
+	}
 }
@@ -0,0 +1,11 @@
+package state
+
+// newTestCache builds a bare cache for tests that only need its zero-value
+// bookkeeping (states, seriesInPreviousEval, ctxTree, ruleIndexes)
+// initialized, with no logger/metrics/externalURL wiring. Shared by
+// replace_test.go, restore_test.go and eviction_test.go so a new cache field
+// only needs to be added to newCache, not to every test file's own copy of
+// this literal.
+func newTestCache() *cache {
+	return newCache(nil, nil, nil)
+}
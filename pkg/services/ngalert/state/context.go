@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"sync"
+)
+
+// scopeKey identifies the context scope a cancellation applies to: either an
+// entire org, or a single rule within one.
+type scopeKey struct {
+	orgID int64
+	uid   string // empty for an org-wide scope
+}
+
+// scopedContext tracks the per-org/per-rule cancellation tree used to abort
+// in-flight template expansion and backend calls when a rule is deleted or
+// an org is paused mid-evaluation. cache holds one so getOrCreate has a
+// single place to derive contexts from before it reaches prepareInstance.
+// Every context it hands out is derived from the ctx the caller passed
+// in, so deadlines, values and upstream cancellation (shutdown, the overall
+// eval timeout, tracing) keep flowing through exactly as they did before
+// this tree existed; CancelOrg/CancelRule are an additional way to cancel
+// that same context, not a replacement root for it.
+//
+// getOrCreate can have many calls for the same rule in flight at once (that's
+// the whole point of making prepareInstance cancelable — a rule can evaluate
+// hundreds of series concurrently), so a scopeKey maps to a set of cancel
+// funcs keyed by a per-call token rather than a single slot.
+type scopedContext struct {
+	mtx     sync.Mutex
+	nextID  uint64
+	cancels map[scopeKey]map[uint64]context.CancelFunc
+}
+
+func newScopedContext() *scopedContext {
+	return &scopedContext{
+		cancels: make(map[scopeKey]map[uint64]context.CancelFunc),
+	}
+}
+
+// forRule returns a context derived directly from ctx that is additionally
+// canceled by either CancelOrg(orgID) or CancelRule(orgID, uid), whichever
+// comes first. The returned cancel func should be deferred by the caller to
+// release the scope's bookkeeping once the operation completes normally.
+func (s *scopedContext) forRule(ctx context.Context, orgID int64, uid string) (context.Context, context.CancelFunc) {
+	ruleCtx, ruleCancel := context.WithCancel(ctx)
+
+	key := scopeKey{orgID: orgID, uid: uid}
+	s.mtx.Lock()
+	id := s.nextID
+	s.nextID++
+	if s.cancels[key] == nil {
+		s.cancels[key] = make(map[uint64]context.CancelFunc)
+	}
+	s.cancels[key][id] = ruleCancel
+	s.mtx.Unlock()
+
+	return ruleCtx, func() {
+		s.mtx.Lock()
+		if set, ok := s.cancels[key]; ok {
+			delete(set, id)
+			if len(set) == 0 {
+				delete(s.cancels, key)
+			}
+		}
+		s.mtx.Unlock()
+		ruleCancel()
+	}
+}
+
+// CancelOrg cancels any in-flight template expansion or backend call
+// belonging to orgID, e.g. because the org was paused mid-evaluation.
+func (s *scopedContext) CancelOrg(orgID int64) {
+	s.cancelPrefix(orgID)
+}
+
+// CancelRule cancels any in-flight template expansion or backend call
+// belonging to a single rule, e.g. because the rule was deleted.
+func (s *scopedContext) CancelRule(orgID int64, uid string) {
+	key := scopeKey{orgID: orgID, uid: uid}
+	s.mtx.Lock()
+	set := s.cancels[key]
+	delete(s.cancels, key)
+	s.mtx.Unlock()
+	for _, cancel := range set {
+		cancel()
+	}
+}
+
+func (s *scopedContext) cancelPrefix(orgID int64) {
+	s.mtx.Lock()
+	var toCancel []context.CancelFunc
+	for k, set := range s.cancels {
+		if k.orgID == orgID {
+			for _, cancel := range set {
+				toCancel = append(toCancel, cancel)
+			}
+			delete(s.cancels, k)
+		}
+	}
+	s.mtx.Unlock()
+	for _, cancel := range toCancel {
+		cancel()
+	}
+}
+
+// CancelOrg cancels any in-flight template expansion or backend call for
+// orgID. See scopedContext.CancelOrg.
+func (c *cache) CancelOrg(orgID int64) {
+	c.ctxTree.CancelOrg(orgID)
+}
+
+// CancelRule cancels any in-flight template expansion or backend call for a
+// single rule. See scopedContext.CancelRule.
+func (c *cache) CancelRule(orgID int64, uid string) {
+	c.ctxTree.CancelRule(orgID, uid)
+}
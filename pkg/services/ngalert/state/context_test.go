@@ -0,0 +1,76 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopedContext_OverlappingForRuleCallsDoNotClobberEachOther(t *testing.T) {
+	const orgID = int64(1)
+	const uid = "rule-1"
+	s := newScopedContext()
+
+	ctx1, done1 := s.forRule(context.Background(), orgID, uid)
+	ctx2, done2 := s.forRule(context.Background(), orgID, uid)
+
+	// Both calls are for the same rule, but neither should have canceled the
+	// other's context just by being created.
+	require.NoError(t, ctx1.Err())
+	require.NoError(t, ctx2.Err())
+
+	// done() for the first call must not cancel the second call's still
+	// in-flight context, nor remove its registration from the tree.
+	done1()
+	require.NoError(t, ctx2.Err())
+
+	s.CancelRule(orgID, uid)
+	require.Error(t, ctx2.Err())
+
+	// done() firing late for an already-removed call must be a no-op, not a
+	// panic or a delete of a newer call's entry.
+	done2()
+}
+
+func TestScopedContext_CancelRuleCancelsAllInFlightCallsForThatRule(t *testing.T) {
+	const orgID = int64(1)
+	const uid = "rule-1"
+	s := newScopedContext()
+
+	var ctxs []context.Context
+	for i := 0; i < 5; i++ {
+		ctx, done := s.forRule(context.Background(), orgID, uid)
+		ctxs = append(ctxs, ctx)
+		defer done()
+	}
+
+	s.CancelRule(orgID, uid)
+	for _, ctx := range ctxs {
+		require.Error(t, ctx.Err())
+	}
+}
+
+func TestScopedContext_ConcurrentForRuleCalls(t *testing.T) {
+	const orgID = int64(1)
+	const uid = "rule-1"
+	s := newScopedContext()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, done := s.forRule(context.Background(), orgID, uid)
+			defer done()
+			select {
+			case <-ctx.Done():
+				t.Error("context canceled unexpectedly")
+			case <-time.After(time.Millisecond):
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,183 @@
+package state
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+// TruncatedAnnotation is set on the surviving Alerting instance of a rule
+// whose cache entries were evicted because it exceeded maxAlertsPerRule, so
+// the UI and API can surface that the rule's state was capped.
+const TruncatedAnnotation = "__alerting_truncated__"
+
+// stateEvictedTotal is declared directly in this package, rather than as a
+// field on metrics.State, since eviction is specific to this code path;
+// metrics.State is shared across the whole ngalert service and isn't
+// touched by this change.
+var stateEvictedTotal = promauto.With(prometheus.DefaultRegisterer).NewCounterVec(prometheus.CounterOpts{
+	Namespace: "grafana",
+	Subsystem: "alerting",
+	Name:      "state_evicted_total",
+	Help:      "Total number of alert state cache entries evicted because a rule exceeded its configured max_alerts_per_rule.",
+}, []string{"org", "rule"})
+
+// ruleIndex is the secondary (orgID, ruleUID) -> LRU-of-cacheIDs index used
+// to bound how many cache entries a single rule can hold. High-cardinality
+// queries (e.g. per-pod alerts in a churning Kubernetes cluster) would
+// otherwise grow c.states unboundedly, since nothing prunes resolved-then
+// gone label sets until the rule itself is deleted.
+type ruleIndex struct {
+	maxAlertsPerRule int
+
+	order *list.List               // most-recently-updated at the back
+	elems map[string]*list.Element // cacheID -> element in order
+
+	// truncated is set once this index has ever evicted an entry, and stays
+	// set for the index's lifetime (a fresh index - e.g. after replaceRule
+	// rebuilds it - starts clean). touchRuleIndexLocked uses it to re-stamp
+	// TruncatedAnnotation on every call once the rule is over its cap, not
+	// only on the call where an eviction actually happened.
+	truncated bool
+}
+
+func newRuleIndex(maxAlertsPerRule int) *ruleIndex {
+	return &ruleIndex{
+		maxAlertsPerRule: maxAlertsPerRule,
+		order:            list.New(),
+		elems:            make(map[string]*list.Element),
+	}
+}
+
+// touch records cacheID as just-updated, moving it to the back of the LRU
+// order, and returns the cacheIDs (if any) that should be evicted to bring
+// the rule back under maxAlertsPerRule.
+func (idx *ruleIndex) touch(cacheID string) []string {
+	if el, ok := idx.elems[cacheID]; ok {
+		idx.order.MoveToBack(el)
+	} else {
+		idx.elems[cacheID] = idx.order.PushBack(cacheID)
+	}
+
+	if idx.maxAlertsPerRule <= 0 {
+		return nil
+	}
+
+	var evicted []string
+	for idx.order.Len() > idx.maxAlertsPerRule {
+		oldest := idx.order.Front()
+		id := oldest.Value.(string)
+		idx.order.Remove(oldest)
+		delete(idx.elems, id)
+		evicted = append(evicted, id)
+	}
+	return evicted
+}
+
+func (idx *ruleIndex) remove(cacheID string) {
+	if el, ok := idx.elems[cacheID]; ok {
+		idx.order.Remove(el)
+		delete(idx.elems, cacheID)
+	}
+}
+
+// touchRuleIndexLocked records a just-updated cache entry in the rule's LRU
+// index, evicting the least-recently-updated entries if the rule is now over
+// its configured cap. The evicted entries are removed from c.states and a
+// grafana_alerting_state_evicted_total counter is incremented. Once the rule
+// has ever been truncated, a TruncatedAnnotation is re-stamped on every
+// Alerting survivor on every call (not only the call where eviction
+// happened), since TruncatedAnnotation isn't in ngModels.InternalAnnotationNameSet
+// and would otherwise be dropped by mergeForwardInternalAnnotations on the
+// very next evaluation that doesn't itself evict anything. Callers must
+// already hold mtxStates.
+func (c *cache) touchRuleIndexLocked(orgID int64, ruleUID, cacheID string) {
+	if c.maxAlertsPerRule <= 0 {
+		return
+	}
+
+	key := ruleEvalKey(orgID, ruleUID)
+	idx, ok := c.ruleIndexes[key]
+	if !ok {
+		idx = newRuleIndex(c.maxAlertsPerRule)
+		c.ruleIndexes[key] = idx
+	}
+
+	evicted := idx.touch(cacheID)
+	rule, ok := c.states[orgID][ruleUID]
+	if !ok {
+		return
+	}
+
+	if len(evicted) > 0 {
+		idx.truncated = true
+		for _, id := range evicted {
+			delete(rule, id)
+		}
+		stateEvictedTotal.WithLabelValues(fmt.Sprint(orgID), ruleUID).Add(float64(len(evicted)))
+	}
+
+	if !idx.truncated {
+		return
+	}
+	for _, remaining := range rule {
+		if remaining.State == eval.Alerting {
+			if remaining.Annotations == nil {
+				remaining.Annotations = make(map[string]string, 1)
+			}
+			remaining.Annotations[TruncatedAnnotation] = "true"
+		}
+	}
+}
+
+// rebuildRuleIndexLocked discards the LRU index for oldUID (its cache
+// entries no longer exist once replaceRule swaps them out) and populates a
+// fresh index for newUID from the cache IDs replaceRule just wrote, applying
+// the same cap/eviction as every other write path. Without this,
+// ruleIndexes would keep listing cache IDs replaceRule dropped - inflating
+// order.Len() and triggering eviction of legitimately fresh entries - while
+// entries replaceRule just added wouldn't be tracked until separately
+// touched. Callers must already hold mtxStates.
+func (c *cache) rebuildRuleIndexLocked(orgID int64, oldUID, newUID string, cacheIDs []string) {
+	delete(c.ruleIndexes, ruleEvalKey(orgID, oldUID))
+	delete(c.ruleIndexes, ruleEvalKey(orgID, newUID))
+	for _, id := range cacheIDs {
+		c.touchRuleIndexLocked(orgID, newUID, id)
+	}
+}
+
+// sweepStaleNormal deletes entries in Normal state whose last evaluation was
+// at least maxAge before now, bounding memory growth from label sets that
+// quietly resolved and stopped being returned by the query without ever
+// triggering markStale (e.g. because the rule itself stopped evaluating).
+func (c *cache) sweepStaleNormal(orgID int64, ruleUID string, now time.Time, maxAge time.Duration) int {
+	c.mtxStates.Lock()
+	defer c.mtxStates.Unlock()
+
+	rule, ok := c.states[orgID][ruleUID]
+	if !ok {
+		return 0
+	}
+
+	idx := c.ruleIndexes[ruleEvalKey(orgID, ruleUID)]
+	var swept int
+	for id, state := range rule {
+		if state.State != eval.Normal {
+			continue
+		}
+		if now.Sub(state.LastEvaluationTime) < maxAge {
+			continue
+		}
+		delete(rule, id)
+		if idx != nil {
+			idx.remove(id)
+		}
+		swept++
+	}
+	return swept
+}
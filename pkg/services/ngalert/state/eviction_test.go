@@ -0,0 +1,158 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+func TestRuleIndex_EvictsLeastRecentlyUpdated(t *testing.T) {
+	idx := newRuleIndex(2)
+
+	require.Empty(t, idx.touch("a"))
+	require.Empty(t, idx.touch("b"))
+
+	// "a" is touched again, so "b" becomes the least-recently-updated entry
+	// and should be the one evicted once the cap is exceeded.
+	require.Empty(t, idx.touch("a"))
+	evicted := idx.touch("c")
+	require.Equal(t, []string{"b"}, evicted)
+
+	require.Equal(t, 2, idx.order.Len())
+	_, stillTracked := idx.elems["b"]
+	require.False(t, stillTracked)
+}
+
+func TestRuleIndex_RemoveDropsEntryFromOrder(t *testing.T) {
+	idx := newRuleIndex(0) // 0 disables the cap, but remove should still work
+	idx.touch("a")
+	idx.touch("b")
+
+	idx.remove("a")
+
+	require.Equal(t, 1, idx.order.Len())
+	_, ok := idx.elems["a"]
+	require.False(t, ok)
+}
+
+func TestTouchRuleIndexLocked_EvictsAndMarksSurvivorsTruncated(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+
+	c := newTestCache()
+	c.maxAlertsPerRule = 1
+	c.states[orgID] = map[string]map[string]*State{
+		ruleUID: {
+			"first":  {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "first", State: eval.Alerting, Annotations: map[string]string{}},
+			"second": {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "second", State: eval.Alerting, Annotations: map[string]string{}},
+		},
+	}
+
+	c.touchRuleIndexLocked(orgID, ruleUID, "first")
+	c.touchRuleIndexLocked(orgID, ruleUID, "second")
+
+	rule := c.states[orgID][ruleUID]
+	require.Len(t, rule, 1, "the rule should be capped at maxAlertsPerRule entries")
+	require.NotContains(t, rule, "first", "the least-recently-touched entry should be the one evicted")
+
+	survivor := rule["second"]
+	require.Equal(t, "true", survivor.Annotations[TruncatedAnnotation])
+}
+
+func TestTouchRuleIndexLocked_ReStampsTruncatedOnCallsThatDontEvict(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+
+	c := newTestCache()
+	c.maxAlertsPerRule = 1
+	c.states[orgID] = map[string]map[string]*State{
+		ruleUID: {
+			"first":  {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "first", State: eval.Alerting, Annotations: map[string]string{}},
+			"second": {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "second", State: eval.Alerting, Annotations: map[string]string{}},
+		},
+	}
+
+	c.touchRuleIndexLocked(orgID, ruleUID, "first")
+	c.touchRuleIndexLocked(orgID, ruleUID, "second") // evicts "first", marks "second" truncated
+
+	survivor := c.states[orgID][ruleUID]["second"]
+	require.Equal(t, "true", survivor.Annotations[TruncatedAnnotation])
+
+	// Simulate the next evaluation re-merging annotations the way getOrCreate
+	// does: mergeForwardInternalAnnotations would drop TruncatedAnnotation
+	// here since it isn't in ngModels.InternalAnnotationNameSet.
+	survivor.Annotations = map[string]string{}
+
+	// A further touch for the same (still-capped) entry, with no new
+	// eviction this round, must re-stamp the annotation rather than leaving
+	// it dropped.
+	c.touchRuleIndexLocked(orgID, ruleUID, "second")
+	require.Equal(t, "true", survivor.Annotations[TruncatedAnnotation],
+		"the rule is still over its cap, so the annotation must not flicker off on a call that doesn't itself evict")
+}
+
+func TestSweepStaleNormal_DeletesOldNormalEntriesAndUpdatesIndex(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+
+	c := newTestCache()
+	c.maxAlertsPerRule = 10
+	now := time.Unix(10000, 0)
+
+	c.states[orgID] = map[string]map[string]*State{
+		ruleUID: {
+			"stale-normal": {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "stale-normal", State: eval.Normal, LastEvaluationTime: now.Add(-time.Hour)},
+			"fresh-normal": {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "fresh-normal", State: eval.Normal, LastEvaluationTime: now},
+			"alerting":     {AlertRuleUID: ruleUID, OrgID: orgID, CacheId: "alerting", State: eval.Alerting, LastEvaluationTime: now.Add(-time.Hour)},
+		},
+	}
+	c.touchRuleIndexLocked(orgID, ruleUID, "stale-normal")
+	c.touchRuleIndexLocked(orgID, ruleUID, "fresh-normal")
+	c.touchRuleIndexLocked(orgID, ruleUID, "alerting")
+
+	swept := c.sweepStaleNormal(orgID, ruleUID, now, 10*time.Minute)
+	require.Equal(t, 1, swept)
+
+	rule := c.states[orgID][ruleUID]
+	require.NotContains(t, rule, "stale-normal", "a Normal entry past maxAge should be swept")
+	require.Contains(t, rule, "fresh-normal", "a recently-evaluated Normal entry should survive")
+	require.Contains(t, rule, "alerting", "sweepStaleNormal only touches Normal entries")
+
+	idx := c.ruleIndexes[ruleEvalKey(orgID, ruleUID)]
+	_, stillTracked := idx.elems["stale-normal"]
+	require.False(t, stillTracked, "the swept entry must also be dropped from the LRU index")
+}
+
+func TestReplaceRule_RebuildsRuleIndex(t *testing.T) {
+	const orgID = int64(1)
+	const oldUID = "old-uid"
+	oldRule := &ngModels.AlertRule{UID: oldUID, NamespaceUID: "ns", Title: "cpu high"}
+
+	c := newTestCache()
+	c.maxAlertsPerRule = 5
+
+	lbs := data.Labels{"pod": "a"}
+	attachRuleLabels(lbs, oldRule)
+	id, err := ngModels.InstanceLabels(lbs).StringKey()
+	require.NoError(t, err)
+
+	c.states[orgID] = map[string]map[string]*State{
+		oldUID: {id: {AlertRuleUID: oldUID, OrgID: orgID, CacheId: id, Labels: lbs, Annotations: map[string]string{}}},
+	}
+	c.touchRuleIndexLocked(orgID, oldUID, id)
+	require.Contains(t, c.ruleIndexes, ruleEvalKey(orgID, oldUID))
+
+	newRule := &ngModels.AlertRule{UID: "new-uid", NamespaceUID: "ns", Title: "cpu high"}
+	c.replaceRule(orgID, oldUID, newRule, []data.Labels{{"pod": "a"}}, nil)
+
+	require.NotContains(t, c.ruleIndexes, ruleEvalKey(orgID, oldUID), "the old rule's index should be discarded, not left pointing at dropped entries")
+
+	newIdx, ok := c.ruleIndexes[ruleEvalKey(orgID, newRule.UID)]
+	require.True(t, ok, "replaceRule should populate an index for the new rule UID")
+	require.Equal(t, 1, newIdx.order.Len())
+}
@@ -0,0 +1,168 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	"github.com/grafana/grafana/pkg/services/ngalert/metrics"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// redisHashKey returns the hash that holds every cached state for a rule.
+// Fields within the hash are cacheIDs, so RemoveByRuleUID is a single DEL of
+// the whole key and per-instance writes are a single HSET field.
+func redisHashKey(orgID int64, ruleUID string) string {
+	return fmt.Sprintf("grafana:alertstate:%d:%s", orgID, ruleUID)
+}
+
+// stateStoreRedis is a StateStore backed by a shared Redis instance, used so
+// alert state survives a single ruler replica restarting and stays
+// consistent when the ruler is scaled across multiple Grafana instances.
+type stateStoreRedis struct {
+	client      *redis.Client
+	log         log.Logger
+	metrics     *metrics.State
+	externalURL *url.URL
+}
+
+func newStateStoreRedis(client *redis.Client, logger log.Logger, metrics *metrics.State, externalURL *url.URL) *stateStoreRedis {
+	return &stateStoreRedis{
+		client:      client,
+		log:         logger,
+		metrics:     metrics,
+		externalURL: externalURL,
+	}
+}
+
+func (s *stateStoreRedis) GetOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
+	// Label/annotation expansion and the cache ID derivation go through the
+	// same prepareInstance helper the in-memory store uses, so the same
+	// rule/instance produces the same label set, annotations and cache ID
+	// regardless of which backend is selected.
+	lbs, annotations, id := prepareInstance(ctx, alertRule, result, s.log, s.externalURL)
+
+	key := redisHashKey(alertRule.OrgID, alertRule.UID)
+	if existing, err := s.readField(ctx, key, id); err == nil && existing != nil {
+		existing.Annotations = mergeForwardInternalAnnotations(existing.Annotations, annotations)
+		existing.EvaluationDuration = result.EvaluationDuration
+		s.writeField(ctx, key, id, existing)
+		return existing
+	}
+
+	newState := &State{
+		AlertRuleUID:       alertRule.UID,
+		OrgID:              alertRule.OrgID,
+		CacheId:            id,
+		Labels:             lbs,
+		Annotations:        annotations,
+		EvaluationDuration: result.EvaluationDuration,
+	}
+	if result.State == eval.Alerting {
+		newState.StartsAt = result.EvaluatedAt
+	}
+	s.writeField(ctx, key, id, newState)
+	return newState
+}
+
+func (s *stateStoreRedis) Get(orgID int64, alertRuleUID, stateID string) (*State, error) {
+	state, err := s.readField(context.Background(), redisHashKey(orgID, alertRuleUID), stateID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, fmt.Errorf("no entry for %s:%s was found", alertRuleUID, stateID)
+	}
+	return state, nil
+}
+
+func (s *stateStoreRedis) GetAll(orgID int64) []*State {
+	var states []*State
+	iter := s.client.Scan(context.Background(), 0, fmt.Sprintf("grafana:alertstate:%d:*", orgID), 0).Iterator()
+	for iter.Next(context.Background()) {
+		states = append(states, s.readAllFields(context.Background(), iter.Val())...)
+	}
+	return states
+}
+
+func (s *stateStoreRedis) GetStatesForRuleUID(orgID int64, alertRuleUID string) []*State {
+	return s.readAllFields(context.Background(), redisHashKey(orgID, alertRuleUID))
+}
+
+func (s *stateStoreRedis) Set(entry *State) {
+	s.writeField(context.Background(), redisHashKey(entry.OrgID, entry.AlertRuleUID), entry.CacheId, entry)
+}
+
+func (s *stateStoreRedis) DeleteEntry(orgID int64, alertRuleUID, cacheID string) {
+	if err := s.client.HDel(context.Background(), redisHashKey(orgID, alertRuleUID), cacheID).Err(); err != nil {
+		s.log.Error("failed to delete redis state entry", "org", orgID, "rule", alertRuleUID, "err", err)
+	}
+}
+
+func (s *stateStoreRedis) RemoveByRuleUID(orgID int64, uid string) {
+	if err := s.client.Del(context.Background(), redisHashKey(orgID, uid)).Err(); err != nil {
+		s.log.Error("failed to remove redis state for rule", "org", orgID, "rule", uid, "err", err)
+	}
+}
+
+func (s *stateStoreRedis) Reset() {
+	// Not implemented: the redis state store has no bulk-clear operation yet.
+	// Use RemoveByRuleUID per rule instead.
+	s.log.Warn("Reset is not supported by the redis state store; use RemoveByRuleUID per rule instead")
+}
+
+func (s *stateStoreRedis) RecordMetrics() {
+	// Not implemented: the redis state store does not expose cache-size
+	// gauges. Iterating every key to compute them would be expensive against
+	// a shared Redis instance, and nothing in this package currently
+	// computes them another way.
+}
+
+func (s *stateStoreRedis) readField(ctx context.Context, key, field string) (*State, error) {
+	raw, err := s.client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal([]byte(raw), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *stateStoreRedis) readAllFields(ctx context.Context, key string) []*State {
+	raw, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		s.log.Error("failed to read redis state hash", "key", key, "err", err)
+		return nil
+	}
+	states := make([]*State, 0, len(raw))
+	for _, v := range raw {
+		var state State
+		if err := json.Unmarshal([]byte(v), &state); err != nil {
+			s.log.Error("failed to unmarshal redis state entry", "key", key, "err", err)
+			continue
+		}
+		states = append(states, &state)
+	}
+	return states
+}
+
+func (s *stateStoreRedis) writeField(ctx context.Context, key, field string, state *State) {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		s.log.Error("failed to marshal state entry for redis", "err", err)
+		return
+	}
+	if err := s.client.HSet(ctx, key, field, raw).Err(); err != nil {
+		s.log.Error("failed to write redis state entry", "key", key, "err", err)
+	}
+}
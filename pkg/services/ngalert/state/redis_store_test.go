@@ -0,0 +1,25 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+func TestRedisHashKey(t *testing.T) {
+	require.Equal(t, "grafana:alertstate:1:rule-1", redisHashKey(1, "rule-1"))
+	require.NotEqual(t, redisHashKey(1, "rule-1"), redisHashKey(2, "rule-1"), "keys must not collide across orgs")
+	require.NotEqual(t, redisHashKey(1, "rule-1"), redisHashKey(1, "rule-2"), "keys must not collide across rules")
+}
+
+func TestNewStateStoreRedis_ImplementsStateStoreButNotAdvancedStateStore(t *testing.T) {
+	s := newStateStoreRedis(nil, log.NewNopLogger(), nil, nil)
+
+	var store StateStore = s
+	require.NotNil(t, store)
+
+	_, ok := store.(AdvancedStateStore)
+	require.False(t, ok, "the redis backend does not implement batched restore, stale-series resolution, cancellation or eviction")
+}
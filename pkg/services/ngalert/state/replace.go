@@ -0,0 +1,98 @@
+package state
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+	prometheusModel "github.com/prometheus/common/model"
+)
+
+// KeepStateFunc decides which fields of an old cache entry should be carried
+// over onto its replacement when a rule is updated. It is invoked once per
+// matched (old, new) pair before the new entry replaces the old one.
+type KeepStateFunc func(old, new *State)
+
+// DefaultKeepState carries over StartsAt, State and any internal annotations
+// from the old entry onto the new one. It is the KeepStateFunc replaceRule
+// uses unless the caller supplies its own.
+func DefaultKeepState(old, new *State) {
+	new.StartsAt = old.StartsAt
+	new.State = old.State
+	for k, v := range old.Annotations {
+		if _, ok := ngModels.InternalAnnotationNameSet[k]; ok {
+			new.Annotations[k] = v
+		}
+	}
+}
+
+// replaceRule updates the cache for a rule whose definition has changed.
+// Unlike removeByRuleUID, it does not unconditionally discard state: for
+// each of the new rule's expected label sets, it looks for an old entry with
+// the same (alertname, labels) identity and, if found, runs keepState to
+// carry forward fields such as StartsAt and pending-duration progress before
+// the old entries are dropped. This avoids resetting still-valid series back
+// to Pending just because the rule's expression or labels were edited.
+func (c *cache) replaceRule(orgID int64, oldUID string, newRule *ngModels.AlertRule, newLabelSets []data.Labels, keepState KeepStateFunc) {
+	if keepState == nil {
+		keepState = DefaultKeepState
+	}
+
+	c.mtxStates.Lock()
+	defer c.mtxStates.Unlock()
+
+	byIdentity := make(map[string]*State, len(c.states[orgID][oldUID]))
+	for _, state := range c.states[orgID][oldUID] {
+		byIdentity[labelIdentity(state.Labels)] = state
+	}
+
+	replaced := make(map[string]*State, len(newLabelSets))
+	for _, original := range newLabelSets {
+		// clone before attaching so we don't mutate caller-owned label sets,
+		// matching the convention in getOrCreate/prepareInstance.
+		lbs := original.Copy()
+		attachRuleLabels(lbs, newRule)
+		id, err := ngModels.InstanceLabels(lbs).StringKey()
+		if err != nil {
+			c.log.Error("error computing cache id while replacing rule", "rule", newRule.UID, "err", err)
+			continue
+		}
+
+		newState := &State{
+			AlertRuleUID: newRule.UID,
+			OrgID:        orgID,
+			CacheId:      id,
+			Labels:       lbs,
+			Annotations:  make(map[string]string),
+		}
+		if old, ok := byIdentity[labelIdentity(lbs)]; ok {
+			keepState(old, newState)
+		}
+		replaced[id] = newState
+	}
+
+	delete(c.states[orgID], oldUID)
+	if _, ok := c.states[orgID]; !ok {
+		c.states[orgID] = make(map[string]map[string]*State)
+	}
+	c.states[orgID][newRule.UID] = replaced
+
+	cacheIDs := make([]string, 0, len(replaced))
+	for id := range replaced {
+		cacheIDs = append(cacheIDs, id)
+	}
+	c.rebuildRuleIndexLocked(orgID, oldUID, newRule.UID, cacheIDs)
+}
+
+// labelIdentity is the part of a label set that identifies "the same alert"
+// across a rule edit: the alert name plus the rest of the labels, excluding
+// the rule/namespace UID labels that attachRuleLabels stamps on and that
+// can change when a rule is replaced.
+func labelIdentity(lbs data.Labels) string {
+	name := lbs[prometheusModel.AlertNameLabel]
+	cp := lbs.Copy()
+	delete(cp, ngModels.RuleUIDLabel)
+	delete(cp, ngModels.NamespaceUIDLabel)
+	delete(cp, prometheusModel.AlertNameLabel)
+	key, _ := ngModels.InstanceLabels(cp).StringKey()
+	return name + "\xff" + key
+}
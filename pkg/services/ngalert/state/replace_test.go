@@ -0,0 +1,65 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+func TestReplaceRule_CarriesForwardStateByIdentity(t *testing.T) {
+	const orgID = int64(1)
+	const oldUID = "old-uid"
+	oldRule := &ngModels.AlertRule{UID: oldUID, NamespaceUID: "ns", Title: "cpu high"}
+
+	c := newTestCache()
+	startsAt := time.Unix(500, 0)
+	lbs := data.Labels{"pod": "a"}
+	attachRuleLabels(lbs, oldRule)
+	id, err := ngModels.InstanceLabels(lbs).StringKey()
+	require.NoError(t, err)
+
+	c.states[orgID] = map[string]map[string]*State{
+		oldUID: {
+			id: {
+				AlertRuleUID: oldUID,
+				OrgID:        orgID,
+				CacheId:      id,
+				Labels:       lbs,
+				Annotations:  map[string]string{},
+				State:        eval.Alerting,
+				StartsAt:     startsAt,
+			},
+		},
+	}
+
+	newRule := &ngModels.AlertRule{UID: "new-uid", NamespaceUID: "ns", Title: "cpu high"}
+	newLabelSets := []data.Labels{{"pod": "a"}}
+
+	c.replaceRule(orgID, oldUID, newRule, newLabelSets, nil)
+
+	require.Empty(t, c.states[orgID][oldUID], "old rule UID should no longer have entries")
+	require.Len(t, c.states[orgID][newRule.UID], 1)
+
+	for _, state := range c.states[orgID][newRule.UID] {
+		require.Equal(t, eval.Alerting, state.State, "matching identity should carry the old State forward")
+		require.Equal(t, startsAt, state.StartsAt, "matching identity should carry StartsAt forward instead of resetting pending progress")
+	}
+}
+
+func TestReplaceRule_DoesNotMutateCallerLabelSets(t *testing.T) {
+	const orgID = int64(1)
+	c := newTestCache()
+
+	newRule := &ngModels.AlertRule{UID: "new-uid", NamespaceUID: "ns", Title: "cpu high"}
+	original := data.Labels{"pod": "a"}
+	newLabelSets := []data.Labels{original}
+
+	c.replaceRule(orgID, "old-uid", newRule, newLabelSets, nil)
+
+	require.Equal(t, data.Labels{"pod": "a"}, original, "replaceRule must not attach rule-identity labels onto the caller's label set")
+}
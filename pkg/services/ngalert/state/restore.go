@@ -0,0 +1,141 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	prometheusModel "github.com/prometheus/common/model"
+
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// restoreDuration and restoredInstancesTotal are declared directly in this
+// package, rather than as fields on metrics.State, since batched restore is
+// specific to this code path; metrics.State is shared across the whole
+// ngalert service and isn't touched by this change.
+var (
+	restoreDuration = promauto.With(prometheus.DefaultRegisterer).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Subsystem: "alerting",
+		Name:      "state_restore_duration_seconds",
+		Help:      "Time taken to batch-restore a single rule's alert state from history on startup.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"org", "rule"})
+
+	restoredInstancesTotal = promauto.With(prometheus.DefaultRegisterer).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "alerting",
+		Name:      "state_restored_instances_total",
+		Help:      "Total number of alert instances whose StartsAt was restored from history on startup.",
+	}, []string{"org"})
+)
+
+// RestoredInstance is a single previously-persisted alert instance, as read
+// back from the ALERTS_FOR_STATE series (or, in Grafana's case, the
+// annotation history table) during startup restore.
+type RestoredInstance struct {
+	Labels   data.Labels
+	ActiveAt time.Time
+	StartsAt time.Time
+}
+
+// InstanceHistoryReader fetches the most recently persisted alert instances
+// for a batch of rules in a single call. Implementations back this with
+// whatever store holds state history (the annotation table today).
+type InstanceHistoryReader interface {
+	QueryInstancesForRules(ctx context.Context, orgID int64, ruleUIDs []string) (map[string][]RestoredInstance, error)
+}
+
+// restoreStartsAt hydrates StartsAt for cache entries belonging to the given
+// rules by issuing a single batched query per call instead of one lookup per
+// alert instance. Cache entries for the rules are expected to already exist
+// (created by the initial evaluation pass); restored series are matched
+// against them by label set and only StartsAt is carried over.
+func (c *cache) restoreStartsAt(ctx context.Context, orgID int64, ruleUIDs []string, reader InstanceHistoryReader) {
+	if len(ruleUIDs) == 0 {
+		return
+	}
+
+	start := time.Now()
+	byRule, err := reader.QueryInstancesForRules(ctx, orgID, ruleUIDs)
+	if err != nil {
+		c.log.Error("failed to batch restore alert state", "org", orgID, "rules", len(ruleUIDs), "err", err)
+		return
+	}
+
+	var totalRestored int
+	for _, uid := range ruleUIDs {
+		restored, ok := byRule[uid]
+		if !ok || len(restored) == 0 {
+			continue
+		}
+
+		ruleStart := time.Now()
+		n := c.restoreStartsAtForRule(orgID, uid, restored)
+		totalRestored += n
+		restoreDuration.WithLabelValues(fmt.Sprint(orgID), uid).Observe(time.Since(ruleStart).Seconds())
+		c.log.Debug("restored state for rule", "org", orgID, "rule", uid, "instances", n, "duration", time.Since(ruleStart))
+	}
+
+	restoredInstancesTotal.WithLabelValues(fmt.Sprint(orgID)).Add(float64(totalRestored))
+	c.log.Info("batch restored alert state", "org", orgID, "rules", len(ruleUIDs), "instances", totalRestored, "duration", time.Since(start))
+}
+
+// restoreStartsAtForRule matches restored series against the cache entries
+// already present for ruleUID by label set, setting StartsAt on each match.
+// It returns the number of entries that were restored.
+func (c *cache) restoreStartsAtForRule(orgID int64, ruleUID string, restored []RestoredInstance) int {
+	candidates := c.getStatesForRuleUID(orgID, ruleUID)
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	byCacheID := make(map[string]*State, len(candidates))
+	for _, s := range candidates {
+		byCacheID[s.CacheId] = s
+	}
+
+	// Every candidate for this rule went through attachRuleLabels in
+	// prepareInstance, so they all carry the same rule-identity labels. The
+	// InstanceHistoryReader isn't required to hand those back on restored
+	// series, so re-stamp them from a candidate before deriving the cache ID
+	// the same way getOrCreate does; otherwise a reader that returns bare
+	// instance labels would make every lookup below miss silently.
+	identity := ruleIdentityLabels(candidates[0].Labels)
+
+	var n int
+	for _, r := range restored {
+		labels := r.Labels.Copy()
+		for k, v := range identity {
+			labels[k] = v
+		}
+		id, err := ngModels.InstanceLabels(labels).StringKey()
+		if err != nil {
+			c.log.Error("error computing cache id for restored instance", "rule", ruleUID, "err", err)
+			continue
+		}
+		state, ok := byCacheID[id]
+		if !ok {
+			continue
+		}
+		state.StartsAt = r.StartsAt
+		c.set(state)
+		n++
+	}
+	return n
+}
+
+// ruleIdentityLabels extracts the rule-identity labels attachRuleLabels
+// stamps onto every cache entry's label set, so restored series can be
+// re-stamped with them before the cache ID is derived.
+func ruleIdentityLabels(lbs data.Labels) data.Labels {
+	return data.Labels{
+		ngModels.RuleUIDLabel:          lbs[ngModels.RuleUIDLabel],
+		ngModels.NamespaceUIDLabel:     lbs[ngModels.NamespaceUIDLabel],
+		prometheusModel.AlertNameLabel: lbs[prometheusModel.AlertNameLabel],
+	}
+}
@@ -0,0 +1,49 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+func TestRestoreStartsAtForRule_IDSchemeMatchesGetOrCreate(t *testing.T) {
+	const orgID = int64(1)
+	rule := &ngModels.AlertRule{UID: "rule-1", NamespaceUID: "ns", Title: "cpu high"}
+
+	c := newTestCache()
+	lbs := data.Labels{"pod": "a"}
+	attachRuleLabels(lbs, rule)
+	id, err := ngModels.InstanceLabels(lbs).StringKey()
+	require.NoError(t, err)
+
+	c.states[orgID] = map[string]map[string]*State{
+		rule.UID: {
+			id: {
+				AlertRuleUID: rule.UID,
+				OrgID:        orgID,
+				CacheId:      id,
+				Labels:       lbs,
+			},
+		},
+	}
+
+	// The history reader hands back only the bare instance labels, without
+	// the rule-identity labels attachRuleLabels would have stamped on them.
+	restored := []RestoredInstance{
+		{Labels: data.Labels{"pod": "a"}, StartsAt: time.Unix(123, 0)},
+	}
+
+	n := c.restoreStartsAtForRule(orgID, rule.UID, restored)
+	require.Equal(t, 1, n, "restore must match the cache entry even when the reader omits rule-identity labels")
+	require.Equal(t, time.Unix(123, 0), c.states[orgID][rule.UID][id].StartsAt)
+}
+
+func TestRestoreStartsAtForRule_NoCandidatesRestoresNothing(t *testing.T) {
+	c := newTestCache()
+	n := c.restoreStartsAtForRule(1, "missing-rule", []RestoredInstance{{Labels: data.Labels{"pod": "a"}}})
+	require.Zero(t, n)
+}
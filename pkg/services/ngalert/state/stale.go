@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+// staleReasonAnnotation marks a state transition that was produced because
+// the underlying series disappeared between evaluations, rather than by a
+// normal evaluation result. It is the Grafana-side equivalent of Prometheus
+// staleness markers (StaleNaN) for series that vanish from a query result.
+const staleReasonAnnotation = "__alerting_stale_series__"
+
+// ruleEvalKey identifies a rule within an org for the purposes of tracking
+// the label-sets seen on its previous evaluation.
+func ruleEvalKey(orgID int64, ruleUID string) string {
+	return fmt.Sprintf("%d/%s", orgID, ruleUID)
+}
+
+// markStale compares the label-sets evaluated this round (currentIDs, keyed
+// by cacheID) against the ones seen on the previous evaluation of the same
+// rule. Any cacheID that is no longer present gets a synthetic terminal
+// transition to Normal with EndsAt set to evaluatedAt, so downstream
+// consumers (and the annotation log) see a clean resolve instead of the
+// instance silently lingering until the rule itself is deleted.
+//
+// Comparison is keyed on cacheID, which is derived from the full label set
+// (name + labels), matching Prometheus's approach so reused rule names with
+// reordered label sets don't spuriously go stale.
+func (c *cache) markStale(orgID int64, ruleUID string, currentIDs map[string]data.Labels, evaluatedAt time.Time) []*State {
+	c.mtxStates.Lock()
+	defer c.mtxStates.Unlock()
+
+	key := ruleEvalKey(orgID, ruleUID)
+	previous := c.seriesInPreviousEval[key]
+
+	var staled []*State
+	for cacheID := range previous {
+		if _, ok := currentIDs[cacheID]; ok {
+			continue
+		}
+		states, ok := c.states[orgID][ruleUID]
+		if !ok {
+			continue
+		}
+		state, ok := states[cacheID]
+		if !ok {
+			continue
+		}
+
+		state.State = eval.Normal
+		state.EndsAt = evaluatedAt
+		state.LastEvaluationTime = evaluatedAt
+		if state.Annotations == nil {
+			state.Annotations = make(map[string]string, 1)
+		}
+		state.Annotations[staleReasonAnnotation] = "true"
+		staled = append(staled, state)
+	}
+
+	if c.seriesInPreviousEval == nil {
+		c.seriesInPreviousEval = make(map[string]map[string]data.Labels)
+	}
+	// clone before storing so a caller mutating or reusing currentIDs after
+	// this call can't corrupt the snapshot the next evaluation compares
+	// against, consistent with how getOrCreate and replaceRule clone labels
+	// before retaining them across calls.
+	snapshot := make(map[string]data.Labels, len(currentIDs))
+	for cacheID, lbs := range currentIDs {
+		snapshot[cacheID] = lbs.Copy()
+	}
+	c.seriesInPreviousEval[key] = snapshot
+
+	return staled
+}
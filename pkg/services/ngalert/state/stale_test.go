@@ -0,0 +1,87 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+func newTestCacheWithState(orgID int64, ruleUID, cacheID string, st eval.State) *cache {
+	c := &cache{
+		states:               make(map[int64]map[string]map[string]*State),
+		seriesInPreviousEval: make(map[string]map[string]data.Labels),
+		ctxTree:              newScopedContext(),
+		ruleIndexes:          make(map[string]*ruleIndex),
+	}
+	c.states[orgID] = map[string]map[string]*State{
+		ruleUID: {
+			cacheID: {
+				AlertRuleUID: ruleUID,
+				OrgID:        orgID,
+				CacheId:      cacheID,
+				State:        st,
+				Annotations:  map[string]string{},
+			},
+		},
+	}
+	return c
+}
+
+func TestMarkStale_ResolvesEntriesMissingFromCurrentEval(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+	c := newTestCacheWithState(orgID, ruleUID, "stale-id", eval.Alerting)
+
+	now := time.Unix(1000, 0)
+	staled := c.markStale(orgID, ruleUID, map[string]data.Labels{"stale-id": {}}, now)
+	require.Empty(t, staled, "first evaluation has nothing to compare against, so nothing should go stale")
+
+	// The second evaluation no longer includes "stale-id": it should resolve.
+	evaluatedAt := now.Add(time.Minute)
+	staled = c.markStale(orgID, ruleUID, map[string]data.Labels{}, evaluatedAt)
+	require.Len(t, staled, 1)
+
+	state := c.states[orgID][ruleUID]["stale-id"]
+	require.Equal(t, eval.Normal, state.State)
+	require.Equal(t, evaluatedAt, state.EndsAt)
+	require.Equal(t, "true", state.Annotations[staleReasonAnnotation])
+}
+
+func TestMarkStale_ClonesCurrentIDsBeforeStoring(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+	c := newTestCacheWithState(orgID, ruleUID, "still-here", eval.Alerting)
+
+	lbs := data.Labels{"pod": "a"}
+	currentIDs := map[string]data.Labels{"still-here": lbs}
+	now := time.Unix(3000, 0)
+	c.markStale(orgID, ruleUID, currentIDs, now)
+
+	// Mutate the caller's map and label set after the call returns.
+	lbs["pod"] = "mutated"
+	currentIDs["still-here"] = data.Labels{"pod": "also-mutated"}
+
+	key := ruleEvalKey(orgID, ruleUID)
+	require.Equal(t, data.Labels{"pod": "a"}, c.seriesInPreviousEval[key]["still-here"],
+		"markStale must clone currentIDs and its labels so caller mutation afterwards can't corrupt the stored snapshot")
+}
+
+func TestMarkStale_LeavesStillPresentEntriesAlone(t *testing.T) {
+	const orgID = int64(1)
+	const ruleUID = "rule-1"
+	c := newTestCacheWithState(orgID, ruleUID, "still-here", eval.Alerting)
+
+	now := time.Unix(2000, 0)
+	c.markStale(orgID, ruleUID, map[string]data.Labels{"still-here": {}}, now)
+
+	staled := c.markStale(orgID, ruleUID, map[string]data.Labels{"still-here": {}}, now.Add(time.Minute))
+	require.Empty(t, staled)
+
+	state := c.states[orgID][ruleUID]["still-here"]
+	require.Equal(t, eval.Alerting, state.State)
+	require.NotContains(t, state.Annotations, staleReasonAnnotation)
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// StateStore is the persistence boundary the state manager uses to read and
+// write alert instance state. The default implementation, cache, keeps
+// everything in memory local to the process; stateStoreRedis backs the same
+// contract with a shared Redis instance so multiple ruler replicas can see a
+// consistent view of alert state.
+type StateStore interface {
+	GetOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State
+	Get(orgID int64, alertRuleUID, stateID string) (*State, error)
+	GetAll(orgID int64) []*State
+	GetStatesForRuleUID(orgID int64, alertRuleUID string) []*State
+	Set(entry *State)
+	DeleteEntry(orgID int64, alertRuleUID, cacheID string)
+	RemoveByRuleUID(orgID int64, uid string)
+	Reset()
+	RecordMetrics()
+}
+
+// AdvancedStateStore is implemented by backends that additionally support
+// batched startup restore, stale-series resolution, per-org/per-rule
+// cancellation and per-rule LRU eviction. Only the in-memory backend, and
+// the redis-migration writeThroughStore that delegates these to it,
+// satisfy it today: a from-scratch Redis implementation of all four would
+// need its own batched history query, its own notion of "previous
+// evaluation" and its own bounded index, none of which exist yet. Callers
+// that depend on these features must type-assert the StateStore returned by
+// NewStateStore against AdvancedStateStore and treat its absence as "this
+// backend does not support it" rather than assuming every StateStore does -
+// NewStateStore logs a warning when the selected backend doesn't implement
+// it.
+type AdvancedStateStore interface {
+	StateStore
+
+	// RestoreStartsAt hydrates StartsAt for cache entries belonging to the
+	// given rules from history, issuing one batched query instead of one
+	// lookup per alert instance.
+	RestoreStartsAt(ctx context.Context, orgID int64, ruleUIDs []string, reader InstanceHistoryReader)
+	// MarkStale resolves any entry for ruleUID that was present on the
+	// previous evaluation but is absent from currentIDs.
+	MarkStale(orgID int64, ruleUID string, currentIDs map[string]data.Labels, evaluatedAt time.Time) []*State
+	// CancelOrg aborts in-flight template expansion and backend calls for
+	// every rule belonging to orgID.
+	CancelOrg(orgID int64)
+	// CancelRule aborts in-flight template expansion and backend calls for
+	// a single rule.
+	CancelRule(orgID int64, uid string)
+	// SweepStaleNormal deletes cache entries for ruleUID that are in Normal
+	// state and haven't been evaluated in the last maxAge, bounding memory
+	// growth from label sets that quietly resolved and stopped being
+	// returned by the query without ever triggering MarkStale. It returns
+	// the number of entries removed. Nothing in this package calls this on
+	// a schedule; the ngalert scheduler is expected to invoke it
+	// periodically per rule (e.g. alongside its own eval tick), the same
+	// way it is expected to drive RestoreStartsAt once at startup.
+	SweepStaleNormal(orgID int64, ruleUID string, now time.Time, maxAge time.Duration) int
+}
+
+var _ AdvancedStateStore = (*cache)(nil)
+
+// GetOrCreate implements StateStore.
+func (c *cache) GetOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
+	return c.getOrCreate(ctx, alertRule, result)
+}
+
+// Get implements StateStore.
+func (c *cache) Get(orgID int64, alertRuleUID, stateID string) (*State, error) {
+	return c.get(orgID, alertRuleUID, stateID)
+}
+
+// GetAll implements StateStore.
+func (c *cache) GetAll(orgID int64) []*State {
+	return c.getAll(orgID)
+}
+
+// GetStatesForRuleUID implements StateStore.
+func (c *cache) GetStatesForRuleUID(orgID int64, alertRuleUID string) []*State {
+	return c.getStatesForRuleUID(orgID, alertRuleUID)
+}
+
+// Set implements StateStore.
+func (c *cache) Set(entry *State) {
+	c.set(entry)
+}
+
+// DeleteEntry implements StateStore.
+func (c *cache) DeleteEntry(orgID int64, alertRuleUID, cacheID string) {
+	c.deleteEntry(orgID, alertRuleUID, cacheID)
+}
+
+// RemoveByRuleUID implements StateStore.
+func (c *cache) RemoveByRuleUID(orgID int64, uid string) {
+	c.removeByRuleUID(orgID, uid)
+}
+
+// Reset implements StateStore.
+func (c *cache) Reset() {
+	c.reset()
+}
+
+// RecordMetrics implements StateStore.
+func (c *cache) RecordMetrics() {
+	c.recordMetrics()
+}
+
+// RestoreStartsAt implements AdvancedStateStore.
+func (c *cache) RestoreStartsAt(ctx context.Context, orgID int64, ruleUIDs []string, reader InstanceHistoryReader) {
+	c.restoreStartsAt(ctx, orgID, ruleUIDs, reader)
+}
+
+// MarkStale implements AdvancedStateStore.
+func (c *cache) MarkStale(orgID int64, ruleUID string, currentIDs map[string]data.Labels, evaluatedAt time.Time) []*State {
+	return c.markStale(orgID, ruleUID, currentIDs, evaluatedAt)
+}
+
+// SweepStaleNormal implements AdvancedStateStore.
+func (c *cache) SweepStaleNormal(orgID int64, ruleUID string, now time.Time, maxAge time.Duration) int {
+	return c.sweepStaleNormal(orgID, ruleUID, now, maxAge)
+}